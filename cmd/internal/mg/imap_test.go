@@ -0,0 +1,50 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import "testing"
+
+func TestRestoreBcc(t *testing.T) {
+	bcc := []string{"a@example.com", "b@example.com"}
+	tests := []struct {
+		name string
+		in   string
+		bcc  []string
+		want string
+	}{
+		{
+			name: "crlf separator",
+			in:   "Subject: hi\r\nTo: x@example.com\r\n\r\nbody\r\n",
+			bcc:  bcc,
+			want: "Subject: hi\r\nTo: x@example.com\r\nBcc: a@example.com\r\nBcc: b@example.com\r\n\r\nbody\r\n",
+		},
+		{
+			name: "lf separator",
+			in:   "Subject: hi\nTo: x@example.com\n\nbody\n",
+			bcc:  bcc,
+			want: "Subject: hi\nTo: x@example.com\r\nBcc: a@example.com\r\nBcc: b@example.com\r\n\r\nbody\n",
+		},
+		{
+			name: "empty bcc leaves message untouched",
+			in:   "Subject: hi\r\n\r\nbody\r\n",
+			bcc:  nil,
+			want: "Subject: hi\r\n\r\nbody\r\n",
+		},
+		{
+			name: "no blank-line separator leaves message untouched",
+			in:   "Subject: hi\r\nTo: x@example.com\r\n",
+			bcc:  bcc,
+			want: "Subject: hi\r\nTo: x@example.com\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := restoreBcc([]byte(tt.in), tt.bcc)
+			if string(got) != tt.want {
+				t.Errorf("restoreBcc(%q, %v) = %q, want %q", tt.in, tt.bcc, got, tt.want)
+			}
+		})
+	}
+}
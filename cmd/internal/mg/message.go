@@ -0,0 +1,335 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A Message builds an RFC 2045 MIME message, with an API modeled after
+// the common gomail/go-mail builder pattern: SetHeader and
+// SetAddressHeader set header fields, SetBody sets the primary body,
+// AddAlternative adds another representation of it (such as an HTML
+// version alongside a plain-text SetBody), and Attach and Embed add
+// files. Plain-text and HTML bodies are quoted-printable encoded;
+// attachments and embedded files are base64 encoded. The zero Message is
+// not usable; create one with NewMessage.
+type Message struct {
+	header      textproto.MIMEHeader
+	headerOrder []string
+	body        *part
+	alternative []*part
+	attachment  []*file
+	embed       []*file
+}
+
+type part struct {
+	contentType string
+	body        []byte
+}
+
+type file struct {
+	name        string
+	contentType string
+	data        []byte
+	contentID   string // set only for Embed, not Attach
+}
+
+// NewMessage returns an empty Message ready for SetHeader, SetBody, and
+// the like.
+func NewMessage() *Message {
+	return &Message{header: textproto.MIMEHeader{}}
+}
+
+// SetHeader sets the header field to the given value or values, replacing
+// any previous value, as in net/mail the keys "To", "From", "Subject",
+// and so on rather than raw MIME field syntax.
+func (m *Message) SetHeader(field string, values ...string) {
+	key := textproto.CanonicalMIMEHeaderKey(field)
+	if _, ok := m.header[key]; !ok {
+		m.headerOrder = append(m.headerOrder, key)
+	}
+	m.header[key] = values
+}
+
+// SetAddressHeader sets field (typically "From", "To", "Cc", or "Bcc")
+// to the given addresses, formatted per RFC 5322.
+func (m *Message) SetAddressHeader(field string, addrs ...*mail.Address) {
+	list := make([]string, len(addrs))
+	for i, a := range addrs {
+		list[i] = a.String()
+	}
+	m.SetHeader(field, strings.Join(list, ", "))
+}
+
+// SetBody sets the primary content of the message, such as
+// SetBody("text/plain", "hello"). Use AddAlternative to add another
+// representation of the same content, such as an HTML version.
+func (m *Message) SetBody(contentType, body string) {
+	m.body = &part{contentType: contentType, body: []byte(body)}
+}
+
+// AddAlternative adds another representation of the message body, such
+// as AddAlternative("text/html", "<p>hello</p>") alongside a SetBody of
+// "text/plain". When more than one body representation is present, they
+// are wrapped in a multipart/alternative part, most preferred last.
+func (m *Message) AddAlternative(contentType, body string) {
+	m.alternative = append(m.alternative, &part{contentType: contentType, body: []byte(body)})
+}
+
+// Attach reads filename from disk and adds it as a multipart/mixed
+// attachment, with its Content-Type guessed from the file's extension
+// and contents.
+func (m *Message) Attach(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	m.attachment = append(m.attachment, &file{
+		name:        filepath.Base(filename),
+		contentType: detectContentType(filename, data),
+		data:        data,
+	})
+	return nil
+}
+
+// Embed reads filename from disk and adds it as an inline
+// multipart/related part with the given Content-ID, for reference from
+// an HTML alternative body as "cid:contentID".
+func (m *Message) Embed(filename, contentID string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	m.embed = append(m.embed, &file{
+		name:        filepath.Base(filename),
+		contentType: detectContentType(filename, data),
+		data:        data,
+		contentID:   contentID,
+	})
+	return nil
+}
+
+func detectContentType(filename string, data []byte) string {
+	if ct := mime.TypeByExtension(filepath.Ext(filename)); ct != "" {
+		return ct
+	}
+	return http.DetectContentType(data)
+}
+
+// WriteTo writes the assembled message, headers followed by the MIME
+// body, to w.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	content, err := m.build()
+	if err != nil {
+		return 0, err
+	}
+	cw := &countingWriter{w: w}
+	for _, k := range m.headerOrder {
+		for _, v := range m.header[k] {
+			fmt.Fprintf(cw, "%s: %s\r\n", k, v)
+		}
+	}
+	writeHeaders(cw, content.header)
+	fmt.Fprintf(cw, "\r\n")
+	cw.Write(content.body)
+	return cw.n, cw.err
+}
+
+// node is one part of the MIME tree under construction: either a leaf
+// (a text body or a file, already transfer-encoded) or a multipart
+// container whose body is the fully rendered child parts.
+type node struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// build assembles the message's body, alternatives, embeds, and
+// attachments into the multipart/mixed -> multipart/alternative ->
+// multipart/related tree described by Message's doc comment, omitting
+// any layer that isn't needed.
+func (m *Message) build() (node, error) {
+	var bodies []node
+	if m.body != nil {
+		bodies = append(bodies, leafNode(m.body.contentType, m.body.body))
+	}
+	for _, p := range m.alternative {
+		bodies = append(bodies, leafNode(p.contentType, p.body))
+	}
+	if len(bodies) == 0 {
+		return node{}, fmt.Errorf("message has no body")
+	}
+
+	content := bodies[0]
+	var err error
+	if len(bodies) > 1 {
+		if content, err = multipartNode("alternative", bodies); err != nil {
+			return node{}, err
+		}
+	}
+
+	if len(m.embed) > 0 {
+		children := append([]node{content}, fileNodes(m.embed, "inline")...)
+		if content, err = multipartNode("related", children); err != nil {
+			return node{}, err
+		}
+	}
+
+	if len(m.attachment) > 0 {
+		children := append([]node{content}, fileNodes(m.attachment, "attachment")...)
+		if content, err = multipartNode("mixed", children); err != nil {
+			return node{}, err
+		}
+	}
+
+	return content, nil
+}
+
+func fileNodes(files []*file, disposition string) []node {
+	nodes := make([]node, len(files))
+	for i, f := range files {
+		nodes[i] = fileNode(f, disposition)
+	}
+	return nodes
+}
+
+func leafNode(contentType string, body []byte) node {
+	enc := "base64"
+	if strings.HasPrefix(contentType, "text/") {
+		enc = "quoted-printable"
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", contentType+"; charset=utf-8")
+	h.Set("Content-Transfer-Encoding", enc)
+	return node{header: h, body: encodeBody(enc, body)}
+}
+
+func fileNode(f *file, disposition string) node {
+	ct := f.contentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", ct)
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, f.name))
+	if f.contentID != "" {
+		h.Set("Content-ID", "<"+f.contentID+">")
+	}
+	return node{header: h, body: encodeBody("base64", f.data)}
+}
+
+func multipartNode(subtype string, children []node) (node, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, c := range children {
+		pw, err := mw.CreatePart(c.header)
+		if err != nil {
+			return node{}, err
+		}
+		if _, err := pw.Write(c.body); err != nil {
+			return node{}, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return node{}, err
+	}
+	h := textproto.MIMEHeader{}
+	h.Set("Content-Type", fmt.Sprintf("multipart/%s; boundary=%q", subtype, mw.Boundary()))
+	return node{header: h, body: buf.Bytes()}, nil
+}
+
+func encodeBody(enc string, body []byte) []byte {
+	var buf bytes.Buffer
+	switch enc {
+	case "quoted-printable":
+		qw := quotedprintable.NewWriter(&buf)
+		qw.Write(body)
+		qw.Close()
+	default:
+		b64 := base64.NewEncoder(base64.StdEncoding, &lineWrapper{w: &buf})
+		b64.Write(body)
+		b64.Close()
+	}
+	return buf.Bytes()
+}
+
+// lineWrapper inserts a CRLF every 76 bytes written, the line length
+// RFC 2045 requires for base64-encoded body content.
+type lineWrapper struct {
+	w io.Writer
+	n int
+}
+
+func (lw *lineWrapper) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		take := 76 - lw.n
+		if take > len(b) {
+			take = len(b)
+		}
+		n, err := lw.w.Write(b[:take])
+		written += n
+		lw.n += n
+		if err != nil {
+			return written, err
+		}
+		b = b[take:]
+		if lw.n == 76 {
+			if _, err := lw.w.Write([]byte("\r\n")); err != nil {
+				return written, err
+			}
+			lw.n = 0
+		}
+	}
+	return written, nil
+}
+
+// writeHeaders writes h to w with its keys in sorted order, the same
+// order mime/multipart.Writer uses, so output is deterministic.
+func writeHeaders(w io.Writer, h textproto.MIMEHeader) {
+	var keys []string
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			fmt.Fprintf(w, "%s: %s\r\n", k, v)
+		}
+	}
+}
+
+// countingWriter counts bytes written and remembers the first error, so
+// Message.WriteTo can satisfy io.WriterTo with a sequence of unchecked
+// Fprintf/Write calls.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,174 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// parseParts parses msg (the output of Message.WriteTo) and returns the
+// Content-Type of every leaf part found by walking the MIME tree,
+// recursing into any multipart part it encounters.
+func parseParts(t *testing.T, msg []byte) []string {
+	t.Helper()
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(msg)))
+	hdr, err := tp.ReadMIMEHeader()
+	if err != nil {
+		t.Fatalf("ReadMIMEHeader: %v", err)
+	}
+	var types []string
+	walkPart(t, hdr.Get("Content-Type"), tp.R, &types)
+	return types
+}
+
+func walkPart(t *testing.T, contentType string, r io.Reader, types *[]string) {
+	t.Helper()
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		t.Fatalf("ParseMediaType(%q): %v", contentType, err)
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		*types = append(*types, mediaType)
+		return
+	}
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		walkPart(t, p.Header.Get("Content-Type"), p, types)
+	}
+}
+
+// write builds and returns the full wire form of m.
+func write(t *testing.T, m *Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestMessageNoBody(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("Subject", "empty")
+	if _, err := m.build(); err == nil {
+		t.Fatal("build() of a bodyless message succeeded, want error")
+	}
+}
+
+func TestMessageAlternativeOnly(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("Subject", "hi")
+	m.SetBody("text/plain", "plain")
+	m.AddAlternative("text/html", "<p>html</p>")
+
+	types := parseParts(t, write(t, m))
+	want := []string{"text/plain", "text/html"}
+	if !equalStrings(types, want) {
+		t.Errorf("got parts %v, want %v", types, want)
+	}
+}
+
+func TestMessageAttachment(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "notes.txt")
+	if err := os.WriteFile(path, []byte("attachment data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMessage()
+	m.SetBody("text/plain", "plain")
+	if err := m.Attach(path); err != nil {
+		t.Fatalf("Attach: %v", err)
+	}
+
+	types := parseParts(t, write(t, m))
+	want := []string{"text/plain", "text/plain"}
+	if !equalStrings(types, want) {
+		t.Errorf("got parts %v, want %v", types, want)
+	}
+}
+
+func TestMessageEmbed(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "pixel.png")
+	if err := os.WriteFile(path, []byte("\x89PNG\r\n\x1a\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMessage()
+	m.SetBody("text/plain", "plain")
+	m.AddAlternative("text/html", `<img src="cid:pixel">`)
+	if err := m.Embed(path, "pixel"); err != nil {
+		t.Fatalf("Embed: %v", err)
+	}
+
+	types := parseParts(t, write(t, m))
+	want := []string{"text/plain", "text/html", "image/png"}
+	if !equalStrings(types, want) {
+		t.Errorf("got parts %v, want %v", types, want)
+	}
+}
+
+func TestEncodeBodyQuotedPrintableTrailingWhitespace(t *testing.T) {
+	// RFC 2045 4.2 requires trailing whitespace on a line to be encoded
+	// (as =20 for a trailing space) rather than left bare, since bare
+	// trailing whitespace is prone to being stripped in transit.
+	got := encodeBody("quoted-printable", []byte("trailing space \r\nnext line"))
+	want := "trailing space=20\r\nnext line"
+	if string(got) != want {
+		t.Errorf("encodeBody(quoted-printable) = %q, want %q", got, want)
+	}
+}
+
+func TestEncodeBodyBase64LineWrap(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100)
+	got := encodeBody("base64", data)
+	lines := strings.Split(strings.TrimRight(string(got), "\r\n"), "\r\n")
+	for i, line := range lines[:len(lines)-1] {
+		if len(line) != 76 {
+			t.Errorf("line %d has length %d, want 76", i, len(line))
+		}
+	}
+	if last := lines[len(lines)-1]; len(last) == 0 || len(last) > 76 {
+		t.Errorf("final line has length %d, want (0, 76]", len(last))
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	if err != nil {
+		t.Fatalf("decoding base64 output: %v", err)
+	}
+	if !bytes.Equal(decoded, data) {
+		t.Errorf("base64 round-trip mismatch: got %q, want %q", decoded, data)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
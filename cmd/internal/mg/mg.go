@@ -0,0 +1,289 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package mg holds the code shared by the mailgun-sendmail, mailgun-smtpd,
+// and mailgun-queued commands: configuration lookup, logging, flag types,
+// and the actual call to the Mailgun HTTP API.
+package mg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Verbose enables extra diagnostic output on stderr.
+var Verbose bool
+
+// DebugHTTP causes the Mailgun HTTP request and response to be logged.
+var DebugHTTP bool
+
+// DisableMail suppresses the actual call to the Mailgun API, for testing
+// the rest of the pipeline without sending real mail.
+var DisableMail bool
+
+// IsTTY reports whether standard input is a terminal. When it is,
+// mailgun-sendmail treats stdin as an interactive sendmail session and
+// applies the usual dot-terminated message convention.
+var IsTTY bool
+
+var logFile *os.File
+
+// Init prepares the mg package for use. It must be called before any other
+// function in the package, including flag registration, since it determines
+// whether standard input is a terminal.
+func Init() {
+	if fi, err := os.Stdin.Stat(); err == nil {
+		IsTTY = fi.Mode()&os.ModeCharDevice != 0
+	}
+	logFile, _ = os.OpenFile("/var/log/mailgun.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+}
+
+// Logf logs a message to /var/log/mailgun.log, if that file can be opened
+// for writing, and to standard error when Verbose is set.
+func Logf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if logFile != nil {
+		fmt.Fprintf(logFile, "%s\n", msg)
+	}
+	if Verbose {
+		fmt.Fprintf(os.Stderr, "mailgun: %s\n", msg)
+	}
+}
+
+// Die logs err and exits with status 1, the same way sendmail reports a
+// fatal submission error to its caller.
+func Die(err error) {
+	Logf("fatal: %v", err)
+	fmt.Fprintf(os.Stderr, "mailgun-sendmail: %v\n", err)
+	os.Exit(1)
+}
+
+// A StringListFlag is a flag.Value that collects repeated string flags,
+// such as repeated -d debugging values, into a slice in the order given.
+type StringListFlag []string
+
+func (f *StringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *StringListFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// An AddrListFlag is a flag.Value that accumulates RFC 5322 addresses
+// given as repeated command-line arguments or header values into a slice
+// of *mail.Address, the form the rest of the package works with.
+type AddrListFlag []*mail.Address
+
+func (f *AddrListFlag) String() string {
+	var list []string
+	for _, a := range *f {
+		list = append(list, a.String())
+	}
+	return strings.Join(list, ", ")
+}
+
+func (f *AddrListFlag) Set(s string) error {
+	addrs, err := mail.ParseAddressList(s)
+	if err != nil {
+		// Many callers pass a single bare address at a time; mail.ParseAddress
+		// is more forgiving about that than ParseAddressList is.
+		addr, err2 := mail.ParseAddress(s)
+		if err2 != nil {
+			return err
+		}
+		addrs = []*mail.Address{addr}
+	}
+	*f = append(*f, addrs...)
+	return nil
+}
+
+// domain, key, apiBase are the parsed form of the $MAILGUNKEY credential:
+// "<domain> api:key-<hexstring>" optionally followed by " <api base url>".
+// Any further lines are "name value" configuration settings, such as
+// dkim_key or imap, available via ConfigValue.
+type credential struct {
+	domain  string
+	key     string
+	apiBase string
+	extra   map[string]string
+}
+
+func readKey() (credential, error) {
+	if s := os.Getenv("MAILGUNKEY"); s != "" {
+		return parseKey(s)
+	}
+	for _, name := range []string{filepath.Join(os.Getenv("HOME"), ".mailgun.key"), "/etc/mailgun.key"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		return parseKey(string(data))
+	}
+	return credential{}, fmt.Errorf("no $MAILGUNKEY and no readable .mailgun.key")
+}
+
+func parseKey(s string) (credential, error) {
+	lines := strings.Split(s, "\n")
+	f := strings.Fields(strings.TrimSpace(lines[0]))
+	if len(f) < 2 {
+		return credential{}, fmt.Errorf("malformed mailgun key (want \"domain api:key-...\")")
+	}
+	c := credential{domain: f[0], key: f[1], apiBase: "https://api.mailgun.net/v3", extra: map[string]string{}}
+	if len(f) >= 3 {
+		c.apiBase = f[2]
+	}
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			name, value, ok = strings.Cut(line, " ")
+		}
+		if !ok {
+			continue
+		}
+		c.extra[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return c, nil
+}
+
+// ConfigValue returns the value of the named setting from the extra
+// configuration lines of $MAILGUNKEY/.mailgun.key, such as "dkim_key" or
+// "imap", and whether it was present.
+func ConfigValue(name string) (string, bool) {
+	cred, err := readKey()
+	if err != nil {
+		return "", false
+	}
+	v, ok := cred.extra[name]
+	return v, ok
+}
+
+// MailMIME sends the message in mime, a full RFC 822/2045 message (headers
+// followed by a blank line and the body), from from to the given
+// recipients, using the Mailgun "Sending a MIME string" API endpoint. It
+// calls Die and does not return if submission fails. Callers that want to
+// retry a failed send themselves, such as the Queue worker, should use
+// SendMIME instead.
+func MailMIME(from *mail.Address, to []*mail.Address, mime io.Reader) {
+	if err := SendMIME(from, to, mime); err != nil {
+		Die(err)
+	}
+}
+
+// SendMIME is the error-returning counterpart of MailMIME: it submits the
+// message to Mailgun and reports the outcome instead of exiting on
+// failure. A 4xx or 5xx response from Mailgun, or a network error talking
+// to it, is returned as a TransientError when the failure looks worth
+// retrying (the queue worker uses this to decide whether to requeue or
+// bounce).
+func SendMIME(from *mail.Address, to []*mail.Address, mime io.Reader) error {
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	cred, err := readKey()
+	if err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := w.WriteField("to", joinAddrs(to)); err != nil {
+		return err
+	}
+	part, err := w.CreateFormFile("message", "message.mime")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, mime); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	url := cred.apiBase + "/" + cred.domain + "/messages.mime"
+	if DisableMail {
+		Logf("nosend: would POST %s from=%s to=%s (%d bytes)", url, from, joinAddrs(to), body.Len())
+		return nil
+	}
+
+	req, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth("api", cred.key)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	if DebugHTTP {
+		Logf("POST %s", url)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return TransientError{fmt.Errorf("sending mail: %v", err)}
+	}
+	defer resp.Body.Close()
+	rbody, _ := io.ReadAll(resp.Body)
+	if DebugHTTP {
+		Logf("%s: %s", resp.Status, rbody)
+	}
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("mailgun: %s: %s", resp.Status, bytes.TrimSpace(rbody))
+		if resp.StatusCode/100 == 5 || resp.StatusCode == 429 {
+			return TransientError{err}
+		}
+		return err
+	}
+	Logf("sent from=%s to=%s", from, joinAddrs(to))
+	return nil
+}
+
+// A TransientError wraps a send failure that is likely to succeed on
+// retry, such as a network error or a Mailgun 5xx or 429 response, as
+// opposed to a permanent rejection like an unparsable message.
+type TransientError struct{ Err error }
+
+func (e TransientError) Error() string { return e.Err.Error() }
+func (e TransientError) Unwrap() error { return e.Err }
+
+// CheckAuth reports whether user and pass match the configured Mailgun
+// credential, for use as an mg.AuthFunc by mailgun-smtpd's -auth mode.
+func CheckAuth(user, pass string) bool {
+	cred, err := readKey()
+	if err != nil {
+		Logf("auth: %v", err)
+		return false
+	}
+	return user == cred.domain && pass == cred.key
+}
+
+func joinAddrs(to []*mail.Address) string {
+	var list []string
+	for _, a := range to {
+		list = append(list, a.Address)
+	}
+	return strings.Join(list, ",")
+}
+
+// readLine reads a single CRLF- or LF-terminated line from r, with the
+// terminator stripped, as used by the SMTP command parser.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,344 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultQueueDir is the on-disk spool used when no directory is given
+// explicitly, matching the traditional /var/spool/mailgun location.
+const DefaultQueueDir = "/var/spool/mailgun"
+
+// MaxAge is how long a message may sit in the queue, retried with
+// exponential backoff, before Run gives up and bounces it back to the
+// sender. The standard sendmail default queue timeout is five days.
+var MaxAge = 5 * 24 * time.Hour
+
+// A Queue is a persistent on-disk spool of outgoing mail, so that
+// mailgun-sendmail can return immediately after accepting a message
+// instead of blocking on the Mailgun API, and so queued messages survive
+// a crash or reboot. Each queued message is two files in Dir: "<id>.env"
+// holds the JSON envelope (sender, recipients, retry state) and
+// "<id>.msg" holds the raw MIME.
+type Queue struct {
+	Dir string
+}
+
+// OpenQueue opens (creating if necessary) the spool directory dir, or
+// DefaultQueueDir if dir is empty.
+func OpenQueue(dir string) (*Queue, error) {
+	if dir == "" {
+		dir = DefaultQueueDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("opening queue: %v", err)
+	}
+	return &Queue{Dir: dir}, nil
+}
+
+// envelope is the persisted metadata for one spooled message.
+type envelope struct {
+	ID          string
+	From        string
+	To          []string
+	Queued      time.Time
+	NextAttempt time.Time
+	Attempts    int
+	LastErr     string
+	Archive     ArchiveOptions `json:",omitempty"`
+}
+
+func (q *Queue) envPath(id string) string { return filepath.Join(q.Dir, id+".env") }
+func (q *Queue) msgPath(id string) string { return filepath.Join(q.Dir, id+".msg") }
+
+// Enqueue spools a message for later delivery by Run, returning the
+// queue id it was assigned. archive, if not its zero value, is applied
+// once the message is successfully delivered; see Archive.
+func (q *Queue) Enqueue(from *mail.Address, to []*mail.Address, mime io.Reader, archive ArchiveOptions) (id string, err error) {
+	data, err := io.ReadAll(mime)
+	if err != nil {
+		return "", err
+	}
+
+	id = fmt.Sprintf("%d.%d", time.Now().UnixNano(), os.Getpid())
+	env := envelope{
+		ID:          id,
+		From:        from.Address,
+		Queued:      time.Now(),
+		NextAttempt: time.Now(),
+		Archive:     archive,
+	}
+	for _, a := range to {
+		env.To = append(env.To, a.Address)
+	}
+
+	if err := os.WriteFile(q.msgPath(id), data, 0600); err != nil {
+		return "", err
+	}
+	if err := q.writeEnv(env); err != nil {
+		os.Remove(q.msgPath(id))
+		return "", err
+	}
+	Logf("queued id=%s from=%s to=%s", id, env.From, strings.Join(env.To, ","))
+	return id, nil
+}
+
+func (q *Queue) writeEnv(env envelope) error {
+	data, err := json.MarshalIndent(env, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(q.envPath(env.ID), data, 0600)
+}
+
+func (q *Queue) readEnv(id string) (envelope, error) {
+	data, err := os.ReadFile(q.envPath(id))
+	if err != nil {
+		return envelope{}, err
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return envelope{}, err
+	}
+	return env, nil
+}
+
+// ids returns the ids of the messages currently spooled, oldest first.
+func (q *Queue) ids() ([]string, error) {
+	entries, err := os.ReadDir(q.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if name := e.Name(); strings.HasSuffix(name, ".env") {
+			ids = append(ids, strings.TrimSuffix(name, ".env"))
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// A QueueEntry summarizes one spooled message, as printed by
+// "mailgun-sendmail -bp".
+type QueueEntry struct {
+	ID       string
+	From     string
+	To       []string
+	Queued   time.Time
+	Attempts int
+	LastErr  string
+}
+
+// List returns the messages currently spooled, oldest first.
+func (q *Queue) List() ([]QueueEntry, error) {
+	ids, err := q.ids()
+	if err != nil {
+		return nil, err
+	}
+	var list []QueueEntry
+	for _, id := range ids {
+		env, err := q.readEnv(id)
+		if err != nil {
+			Logf("queue: %s: %v", id, err)
+			continue
+		}
+		list = append(list, QueueEntry{env.ID, env.From, env.To, env.Queued, env.Attempts, env.LastErr})
+	}
+	return list, nil
+}
+
+// backoff returns the delay before the nth retry (1-based), doubling
+// each time up to a one-hour ceiling.
+func backoff(attempt int) time.Duration {
+	d := time.Minute
+	for i := 0; i < attempt && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+// Run attempts delivery of every spooled message whose NextAttempt has
+// arrived. A message that fails with a TransientError is rescheduled
+// with exponential backoff; one that fails permanently, or has been in
+// the queue longer than MaxAge, is bounced back to its sender as an
+// RFC 3464 delivery-status notification and removed from the queue.
+func (q *Queue) Run() error {
+	ids, err := q.ids()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, id := range ids {
+		env, err := q.readEnv(id)
+		if err != nil {
+			Logf("queue: %s: %v", id, err)
+			continue
+		}
+		if env.NextAttempt.After(now) {
+			continue
+		}
+		q.attempt(env)
+	}
+	return nil
+}
+
+func (q *Queue) attempt(env envelope) {
+	data, err := os.ReadFile(q.msgPath(env.ID))
+	if err != nil {
+		Logf("queue: %s: %v", env.ID, err)
+		return
+	}
+	from := &mail.Address{Address: env.From}
+	var to []*mail.Address
+	for _, a := range env.To {
+		to = append(to, &mail.Address{Address: a})
+	}
+
+	err = SendMIME(from, to, bytes.NewReader(data))
+	if err == nil {
+		Logf("queue: %s delivered", env.ID)
+		Archive(data, env.Archive)
+		q.remove(env.ID)
+		return
+	}
+
+	var terr TransientError
+	if !errors.As(err, &terr) || time.Since(env.Queued) > MaxAge {
+		Logf("queue: %s: giving up: %v", env.ID, err)
+		if berr := q.bounce(env, data, err); berr != nil {
+			Logf("queue: %s: bounce failed: %v", env.ID, berr)
+		}
+		q.remove(env.ID)
+		return
+	}
+
+	env.Attempts++
+	env.LastErr = err.Error()
+	env.NextAttempt = time.Now().Add(backoff(env.Attempts))
+	Logf("queue: %s: deferred until %s: %v", env.ID, env.NextAttempt.Format(time.RFC3339), err)
+	if werr := q.writeEnv(env); werr != nil {
+		Logf("queue: %s: %v", env.ID, werr)
+	}
+}
+
+func (q *Queue) remove(id string) {
+	os.Remove(q.envPath(id))
+	os.Remove(q.msgPath(id))
+}
+
+// bounce builds an RFC 3464 multipart/report delivery-status notification
+// for a message that could not be delivered and delivers it locally to
+// the original sender.
+func (q *Queue) bounce(env envelope, orig []byte, sendErr error) error {
+	if env.From == "" {
+		// The null reverse path: a bounce for a bounce is dropped, not re-bounced.
+		return nil
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: Mail Delivery Subsystem <mailer-daemon>\r\n")
+	fmt.Fprintf(&buf, "To: %s\r\n", env.From)
+	fmt.Fprintf(&buf, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&buf, "MIME-Version: 1.0\r\n")
+
+	w := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/report; report-type=delivery-status; boundary=%q\r\n\r\n", w.Boundary())
+
+	human, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(human, "This message could not be delivered after %d attempts over %s:\n\n%s\n",
+		env.Attempts, time.Since(env.Queued).Round(time.Minute), sendErr)
+
+	status, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(status, "Reporting-MTA: dns; mailgun-queued\r\n\r\n")
+	for _, to := range env.To {
+		fmt.Fprintf(status, "Final-Recipient: rfc822; %s\r\nAction: failed\r\nStatus: 5.0.0\r\nDiagnostic-Code: x-mailgun; %s\r\n\r\n", to, sendErr)
+	}
+
+	rfc822, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+	if err != nil {
+		return err
+	}
+	if _, err := rfc822.Write(orig); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return deliverLocal(env.From, buf.Bytes())
+}
+
+// deliverLocal hands msg to the local mail delivery agent for to,
+// falling back to appending it to ~/Maildir when no MDA is installed.
+// Mailgun-queued is normally installed alongside a mailgun-sendmail that
+// itself occupies /usr/sbin/sendmail, so exec.LookPath("sendmail") would
+// otherwise resolve right back to this package; deliverLocal refuses
+// that to avoid re-submitting a bounce through Mailgun instead of
+// delivering it locally.
+func deliverLocal(to string, msg []byte) error {
+	if path, err := exec.LookPath("sendmail"); err == nil && !isSelf(path) {
+		cmd := exec.Command(path, "-i", to)
+		cmd.Stdin = bytes.NewReader(msg)
+		if err := cmd.Run(); err == nil {
+			return nil
+		}
+	}
+	return AppendMaildir(filepath.Join(os.Getenv("HOME"), "Maildir"), msg)
+}
+
+// isSelf reports whether path resolves to the binary running this
+// process, following symlinks on both sides.
+func isSelf(path string) bool {
+	self, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	selfReal, err1 := filepath.EvalSymlinks(self)
+	pathReal, err2 := filepath.EvalSymlinks(path)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return selfReal == pathReal
+}
+
+// AppendMaildir delivers msg to the Maildir rooted at dir, following the
+// standard write-to-tmp-then-rename-to-new convention.
+func AppendMaildir(dir string, msg []byte) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	name := fmt.Sprintf("%d.%d.mailgun", time.Now().UnixNano(), os.Getpid())
+	tmp := filepath.Join(dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, "new", name))
+}
@@ -0,0 +1,78 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bytes"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	var prev time.Duration
+	for attempt := 1; attempt <= 10; attempt++ {
+		d := backoff(attempt)
+		if d < prev {
+			t.Fatalf("backoff(%d) = %s, less than backoff(%d) = %s", attempt, d, attempt-1, prev)
+		}
+		if d > time.Hour {
+			t.Fatalf("backoff(%d) = %s, exceeds the one-hour ceiling", attempt, d)
+		}
+		prev = d
+	}
+	if got := backoff(20); got != time.Hour {
+		t.Errorf("backoff(20) = %s, want the one-hour ceiling", got)
+	}
+}
+
+func TestQueueAttemptBouncesAfterMaxAge(t *testing.T) {
+	old := MaxAge
+	DisableMail = false
+	defer func() { MaxAge = old }()
+	MaxAge = 0 // every message is immediately "too old" to keep retrying
+
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("MAILGUNKEY", "") // force readKey to fail, so SendMIME errors
+	t.Setenv("PATH", "")       // exec.LookPath("sendmail") must fail
+
+	q, err := OpenQueue(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenQueue: %v", err)
+	}
+	from := &mail.Address{Address: "sender@example.com"}
+	to := []*mail.Address{{Address: "rcpt@example.com"}}
+	id, err := q.Enqueue(from, to, bytes.NewReader([]byte("Subject: hi\r\n\r\nbody\r\n")), ArchiveOptions{})
+	if err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+
+	if err := q.Run(); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if _, err := os.Stat(q.envPath(id)); !os.IsNotExist(err) {
+		t.Errorf("message still in queue after bouncing: %v", err)
+	}
+
+	maildir := filepath.Join(home, "Maildir", "new")
+	entries, err := os.ReadDir(maildir)
+	if err != nil {
+		t.Fatalf("reading bounce Maildir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d bounce messages in %s, want 1", len(entries), maildir)
+	}
+	data, err := os.ReadFile(filepath.Join(maildir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("reading bounce message: %v", err)
+	}
+	if !bytes.Contains(data, []byte("multipart/report")) || !bytes.Contains(data, []byte("message/rfc822")) {
+		t.Errorf("bounce message missing expected parts:\n%s", data)
+	}
+}
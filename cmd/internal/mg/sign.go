@@ -0,0 +1,451 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SignOptions configures DKIM signing for Sign.
+type SignOptions struct {
+	Domain   string   // the signing domain, DKIM's "d=" tag
+	Selector string   // the selector, DKIM's "s=" tag
+	KeyFile  string   // PEM-encoded RSA private key (PKCS#1 or PKCS#8); default: the "dkim_key" setting in .mailgun.key
+	Headers  []string // headers to sign; default defaultSignedHeaders
+}
+
+// defaultSignedHeaders is the header set DKIM implementations
+// conventionally sign when the caller doesn't specify one.
+var defaultSignedHeaders = []string{"From", "To", "Subject", "Date", "Message-Id"}
+
+// Sign DKIM-signs mime, a complete RFC 822/2045 message (headers, a
+// blank line, then the body), and returns it with a DKIM-Signature
+// header prepended. It implements the rsa-sha256 algorithm with
+// relaxed/relaxed canonicalization (RFC 6376).
+func Sign(mime []byte, opts SignOptions) ([]byte, error) {
+	if opts.Domain == "" || opts.Selector == "" {
+		return nil, fmt.Errorf("DKIM signing requires Domain and Selector")
+	}
+	key, err := loadSignKey(opts.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	headers := opts.Headers
+	if len(headers) == 0 {
+		headers = defaultSignedHeaders
+	}
+
+	rawHeader, body := splitMessage(mime)
+	fields := parseHeaderFields(rawHeader)
+
+	bh := base64.StdEncoding.EncodeToString(sha256Sum(canonicalizeBodyRelaxed(body)))
+
+	var sig bytes.Buffer
+	fmt.Fprintf(&sig, "v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n", opts.Domain, opts.Selector)
+	fmt.Fprintf(&sig, "\th=%s; bh=%s; b=", strings.Join(headers, ":"), bh)
+
+	var signed bytes.Buffer
+	for _, h := range headers {
+		if v, ok := fields.get(h); ok {
+			signed.WriteString(canonicalizeHeaderRelaxed(h, v))
+		}
+		// A header named in h= with no matching field canonicalizes to
+		// nothing, per RFC 6376 3.4.2; this lets signers list headers
+		// that are merely absent-safe to include.
+	}
+	signed.WriteString(canonicalizeHeaderRelaxed("DKIM-Signature", sig.String()))
+	// The signed data ends with the unterminated DKIM-Signature field,
+	// so strip the trailing CRLF canonicalizeHeaderRelaxed added.
+	signedBytes := bytes.TrimSuffix(signed.Bytes(), []byte("\r\n"))
+
+	digest := sha256Sum(signedBytes)
+	b, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	if err != nil {
+		return nil, fmt.Errorf("signing DKIM header: %v", err)
+	}
+	sig.WriteString(base64.StdEncoding.EncodeToString(b))
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "DKIM-Signature: %s\r\n", sig.String())
+	out.Write(rawHeader)
+	out.Write(body)
+	return out.Bytes(), nil
+}
+
+func sha256Sum(b []byte) []byte {
+	h := sha256.Sum256(b)
+	return h[:]
+}
+
+// splitMessage splits a raw RFC 822 message into its header block
+// (including the trailing blank line) and its body.
+func splitMessage(mime []byte) (header, body []byte) {
+	for _, sep := range [][]byte{[]byte("\r\n\r\n"), []byte("\n\n")} {
+		if i := bytes.Index(mime, sep); i >= 0 {
+			return mime[:i+len(sep)], mime[i+len(sep):]
+		}
+	}
+	return mime, nil
+}
+
+// headerFields holds parsed, unfolded header fields in their original
+// order, preserving duplicates (mail allows repeated field names).
+type headerFields []struct{ name, value string }
+
+func (f headerFields) get(name string) (string, bool) {
+	for _, h := range f {
+		if strings.EqualFold(h.name, name) {
+			return h.value, true
+		}
+	}
+	return "", false
+}
+
+func parseHeaderFields(rawHeader []byte) headerFields {
+	var fields headerFields
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(rawHeader)))
+	for {
+		line, err := r.ReadContinuedLine()
+		if err != nil || line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, struct{ name, value string }{name, strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+// canonicalizeHeaderRelaxed applies RFC 6376 "relaxed" header
+// canonicalization to one field: lowercase the name, unfold and
+// collapse internal whitespace in the value, trim trailing whitespace,
+// and terminate with CRLF.
+func canonicalizeHeaderRelaxed(name, value string) string {
+	return strings.ToLower(name) + ":" + collapseWhitespace(value) + "\r\n"
+}
+
+func collapseWhitespace(s string) string {
+	fields := strings.Fields(s)
+	return strings.TrimSpace(strings.Join(fields, " "))
+}
+
+// canonicalizeBodyRelaxed applies RFC 6376 "relaxed" body
+// canonicalization: reduce whitespace runs within each line (including
+// a leading run, which collapses to a single space rather than
+// disappearing) to a single space, strip trailing whitespace from each
+// line, and remove any trailing empty lines (an empty body
+// canonicalizes to the empty string, not a single CRLF).
+func canonicalizeBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = reduceWSP(line)
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// reduceWSP collapses every run of spaces and tabs in line to a single
+// space, except a trailing run, which is dropped entirely, per RFC 6376
+// 3.4.4. Unlike strings.Fields, a leading run is collapsed to one space
+// rather than removed.
+func reduceWSP(line string) string {
+	var buf strings.Builder
+	inWSP := false
+	for _, r := range line {
+		if r == ' ' || r == '\t' {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			buf.WriteByte(' ')
+			inWSP = false
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+func loadSignKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		var ok bool
+		path, ok = ConfigValue("dkim_key")
+		if !ok {
+			return nil, fmt.Errorf("no DKIM key configured (set dkim_key in .mailgun.key)")
+		}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading DKIM key: %v", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("DKIM key %s is not PEM-encoded", path)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing DKIM key %s: %v", path, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("DKIM key %s is not an RSA key", path)
+	}
+	return rsaKey, nil
+}
+
+// ErrAllRecipientsDropped is returned by ApplyPolicy when every
+// recipient was filtered out by the allow/deny list, meaning the
+// message should be silently discarded rather than sent or bounced.
+var ErrAllRecipientsDropped = errors.New("mg: all recipients dropped by policy")
+
+// ApplyPolicy rewrites from to an authorized sender per the from_rules
+// setting, if configured, updating headers["From"] to match, and
+// filters to against the recipients_allow/recipients_deny settings, if
+// configured. It returns the filtered recipient list, or
+// ErrAllRecipientsDropped if none survive.
+func ApplyPolicy(from *mail.Address, to []*mail.Address, headers textproto.MIMEHeader) ([]*mail.Address, error) {
+	if path, ok := ConfigValue("from_rules"); ok {
+		rules, err := loadAddrMap(path)
+		if err != nil {
+			return nil, fmt.Errorf("loading from_rules: %v", err)
+		}
+		if rewritten, ok := lookupAddrRule(rules, from.Address); ok {
+			newFrom := &mail.Address{Name: from.Name, Address: rewritten}
+			headers.Set("From", newFrom.String())
+			Logf("policy: rewrote From %s to %s", from.Address, newFrom.Address)
+		}
+	}
+
+	allow, err := loadOptionalAddrSet("recipients_allow")
+	if err != nil {
+		return nil, err
+	}
+	deny, err := loadOptionalAddrSet("recipients_deny")
+	if err != nil {
+		return nil, err
+	}
+	if allow == nil && deny == nil {
+		return to, nil
+	}
+
+	var kept []*mail.Address
+	for _, a := range to {
+		if deny != nil && matchAddrSet(deny, a.Address) {
+			Logf("policy: dropping recipient %s: denied", a.Address)
+			continue
+		}
+		if allow != nil && !matchAddrSet(allow, a.Address) {
+			Logf("policy: dropping recipient %s: not in allow list", a.Address)
+			continue
+		}
+		kept = append(kept, a)
+	}
+	if len(kept) == 0 {
+		return nil, ErrAllRecipientsDropped
+	}
+	return kept, nil
+}
+
+func loadOptionalAddrSet(configKey string) (map[string]bool, error) {
+	path, ok := ConfigValue(configKey)
+	if !ok {
+		return nil, nil
+	}
+	set, err := loadAddrSet(path)
+	if err != nil {
+		return nil, fmt.Errorf("loading %s: %v", configKey, err)
+	}
+	return set, nil
+}
+
+// loadAddrSet reads a file of one address per line, blank lines and
+// lines starting with "#" ignored, into a set. A line starting with "@"
+// matches any address at that domain.
+func loadAddrSet(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		set[strings.ToLower(line)] = true
+	}
+	return set, nil
+}
+
+func matchAddrSet(set map[string]bool, addr string) bool {
+	addr = strings.ToLower(addr)
+	if set[addr] {
+		return true
+	}
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		return set["@"+addr[i+1:]]
+	}
+	return false
+}
+
+// loadAddrMap reads a file of "pattern replacement" pairs, one per
+// line, for From rewriting: pattern is either a full address or an
+// "@domain" wildcard.
+func loadAddrMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		m[strings.ToLower(fields[0])] = fields[1]
+	}
+	return m, nil
+}
+
+func lookupAddrRule(rules map[string]string, addr string) (string, bool) {
+	addr = strings.ToLower(addr)
+	if v, ok := rules[addr]; ok {
+		return v, true
+	}
+	if i := strings.IndexByte(addr, '@'); i >= 0 {
+		if v, ok := rules["@"+addr[i+1:]]; ok {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Prepare runs the shared pre-submission pipeline used by both
+// mailgun-sendmail and the mailgun-smtpd SMTP server: it applies
+// ApplyPolicy to from/to and the message headers, then DKIM-signs the
+// result if dkim_key is configured. Callers pass the returned recipient
+// list and message on to MailMIME, SendMIME, or Queue.Enqueue. Prepare
+// returns ErrAllRecipientsDropped, wrapped, if policy filtered out every
+// recipient; callers should treat that as "silently done", not a
+// failure.
+func Prepare(from *mail.Address, to []*mail.Address, mime []byte) (newTo []*mail.Address, out []byte, err error) {
+	to, mime, err = applyPolicyRaw(from, to, mime)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts, ok := signOptionsFromConfig(); ok {
+		mime, err = Sign(mime, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("DKIM signing: %v", err)
+		}
+	}
+	return to, mime, nil
+}
+
+// Submit is Prepare followed by Queue.Enqueue: it applies policy and
+// DKIM signing, then spools the outcome to q along with archive, to be
+// applied once the message is actually delivered. If policy drops every
+// recipient, Submit logs that and returns ("", nil) rather than an
+// error, since there is nothing left to queue.
+func Submit(q *Queue, from *mail.Address, to []*mail.Address, mime []byte, archive ArchiveOptions) (id string, err error) {
+	to, mime, err = Prepare(from, to, mime)
+	if err != nil {
+		if errors.Is(err, ErrAllRecipientsDropped) {
+			Logf("policy: dropped message from %s: no recipients remain", from.Address)
+			return "", nil
+		}
+		return "", err
+	}
+	return q.Enqueue(from, to, bytes.NewReader(mime), archive)
+}
+
+// signOptionsFromConfig builds SignOptions from the dkim_key,
+// dkim_selector, and dkim_domain settings in .mailgun.key, reporting ok
+// = false if dkim_key isn't configured (signing disabled).
+func signOptionsFromConfig() (SignOptions, bool) {
+	keyFile, ok := ConfigValue("dkim_key")
+	if !ok {
+		return SignOptions{}, false
+	}
+	domain, ok := ConfigValue("dkim_domain")
+	if !ok {
+		if cred, err := readKey(); err == nil {
+			domain = cred.domain
+		}
+	}
+	selector, ok := ConfigValue("dkim_selector")
+	if !ok {
+		selector = "mailgun"
+	}
+	return SignOptions{Domain: domain, Selector: selector, KeyFile: keyFile}, true
+}
+
+// applyPolicyRaw parses mime far enough to run ApplyPolicy over its
+// headers and re-serializes the result. If mime isn't parsable as an
+// RFC 822 message, policy is skipped rather than failing the send.
+func applyPolicyRaw(from *mail.Address, to []*mail.Address, mime []byte) ([]*mail.Address, []byte, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(mime))
+	if err != nil {
+		return to, mime, nil
+	}
+	headers := textproto.MIMEHeader(msg.Header)
+	newTo, err := ApplyPolicy(from, to, headers)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := reserializeMessage(headers, msg.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newTo, out, nil
+}
+
+func reserializeMessage(headers textproto.MIMEHeader, body io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	var keys []string
+	for k := range headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range headers[k] {
+			fmt.Fprintf(&buf, "%s: %s\r\n", k, v)
+		}
+	}
+	fmt.Fprintf(&buf, "\r\n")
+	if _, err := io.Copy(&buf, body); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
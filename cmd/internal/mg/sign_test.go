@@ -0,0 +1,45 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import "testing"
+
+// TestCanonicalizeHeaderRelaxed checks against the worked examples in
+// RFC 6376 3.4.2.
+func TestCanonicalizeHeaderRelaxed(t *testing.T) {
+	tests := []struct {
+		name, value, want string
+	}{
+		{"A", "X", "a:X\r\n"},
+		{"B", "Y\t\r\n\tZ  ", "b:Y Z\r\n"},
+		{"Subject", "  Test   message  ", "subject:Test message\r\n"},
+	}
+	for _, tt := range tests {
+		got := canonicalizeHeaderRelaxed(tt.name, tt.value)
+		if got != tt.want {
+			t.Errorf("canonicalizeHeaderRelaxed(%q, %q) = %q, want %q", tt.name, tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestCanonicalizeBodyRelaxed checks against the worked example in
+// RFC 6376 3.4.4: a leading whitespace run on a line collapses to a
+// single space (it is not removed the way a trailing run is), internal
+// runs collapse to one space, and trailing empty lines are dropped.
+func TestCanonicalizeBodyRelaxed(t *testing.T) {
+	in := " C \r\nD \t E\r\n\r\n\r\n"
+	want := " C\r\nD E\r\n"
+	if got := string(canonicalizeBodyRelaxed([]byte(in))); got != want {
+		t.Errorf("canonicalizeBodyRelaxed(%q) = %q, want %q", in, got, want)
+	}
+}
+
+func TestCanonicalizeBodyRelaxedEmpty(t *testing.T) {
+	for _, in := range []string{"", "\r\n", "\r\n\r\n", "   \r\n"} {
+		if got := canonicalizeBodyRelaxed([]byte(in)); got != nil {
+			t.Errorf("canonicalizeBodyRelaxed(%q) = %q, want nil", in, got)
+		}
+	}
+}
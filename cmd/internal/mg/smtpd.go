@@ -0,0 +1,526 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+// A DotStopReader reads from R, stopping at (and consuming) the first
+// line containing only a single ".", the standard end-of-data marker for
+// both the sendmail -bs stdin convention and the SMTP DATA command.
+type DotStopReader struct {
+	r     io.Reader
+	state int // how far into "\n.\n" have we seen?
+	extra [3]byte
+	dot   int // index in the most recent Read's b where state went 1->2
+}
+
+// NewDotStopReader returns a DotStopReader that reads from r.
+func NewDotStopReader(r io.Reader) *DotStopReader {
+	return &DotStopReader{r: r}
+}
+
+func (r *DotStopReader) Read(b []byte) (int, error) {
+	if len(b) < 4 {
+		panic("DotStopReader must read at least 4 bytes at a time")
+	}
+	if r.state == 3 {
+		return 0, io.EOF
+	}
+	copy(b, r.extra[:r.state])
+	n, err := r.r.Read(b[r.state:])
+	n += r.state
+	r.state = 0
+Loop:
+	for i, c := range b[:n] {
+		switch r.state {
+		case 0:
+			if c == '\r' || c == '\n' {
+				r.state = 1
+			}
+		case 1:
+			switch {
+			case c == '.':
+				r.state = 2
+				r.dot = i
+			case c != '\r' && c != '\n':
+				// Not a dot, and not another line terminator to keep
+				// waiting through: this line doesn't start with ".",
+				// so it's not a terminator candidate.
+				r.state = 0
+			}
+		case 2:
+			switch {
+			case c == '\r' || c == '\n':
+				r.state = 3
+				// Cut right before the ".", not after it: everything up
+				// to here, including the content's own line terminator,
+				// is message data, and the dot line is consumed but
+				// never returned.
+				n = r.dot
+				break Loop
+			default:
+				// The line has more than just a ".", so it was a
+				// dot-stuffed line, not the terminator.
+				r.state = 0
+			}
+		}
+	}
+	if r.state > 0 && r.state < 3 {
+		copy(r.extra[:], b[n-r.state:])
+		n -= r.state
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return 0, err
+}
+
+// AuthFunc checks a set of submitted AUTH credentials, as loaded from
+// $MAILGUNKEY or the operator's config, and reports whether they are
+// valid for submission.
+type AuthFunc func(mechanism, username, password string) bool
+
+// A Config describes how an SMTP submission server (Server) should
+// behave: what it advertises in its EHLO banner, whether it requires
+// AUTH, and whether it offers STARTTLS.
+type Config struct {
+	Hostname  string      // advertised in the greeting and EHLO response
+	Auth      AuthFunc    // if non-nil, AUTH PLAIN/LOGIN is required before MAIL
+	TLSConfig *tls.Config // if non-nil, STARTTLS is offered
+	MaxSize   int64       // advertised via the SIZE extension and enforced in DATA; 0 means unlimited
+}
+
+// A Server implements the server side of the submission subset of
+// RFC 5321 described in the mailgun-smtpd documentation, relaying every
+// accepted message through MailMIME.
+type Server struct {
+	Config
+}
+
+// NewServer returns a Server configured as described by cfg.
+func NewServer(cfg Config) *Server {
+	return &Server{Config: cfg}
+}
+
+// Serve accepts connections on l until it returns an error, serving each
+// one in its own goroutine.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			if err := s.serve(conn, conn, conn); err != nil && err != io.EOF {
+				Logf("smtpd: %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeStdio runs a single SMTP session on standard input and output, as
+// used by "mailgun-sendmail -bs".
+func (s *Server) ServeStdio(stdin io.Reader, stdout io.Writer) error {
+	return s.serve(nil, stdin, stdout)
+}
+
+type session struct {
+	*Server
+	conn net.Conn // nil in -bs mode; used only to upgrade to TLS
+	r    *bufio.Reader
+	w    io.Writer
+
+	helo         string
+	authorized   bool
+	from         *mail.Address
+	to           AddrListFlag
+	eightBitMIME bool
+}
+
+func (s *Server) serve(conn net.Conn, r io.Reader, w io.Writer) error {
+	sess := &session{Server: s, conn: conn, r: bufio.NewReader(r), w: w}
+	sess.reply(220, "%s ESMTP mailgun-smtpd ready", s.hostname())
+	for {
+		line, err := readLine(sess.r)
+		if err != nil {
+			return err
+		}
+		if done, err := sess.dispatch(line); done || err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) hostname() string {
+	if s.Hostname != "" {
+		return s.Hostname
+	}
+	return "localhost"
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) {
+	fmt.Fprintf(sess.w, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+// replyLines writes a multi-line reply, as used for the EHLO response.
+func (sess *session) replyLines(code int, lines ...string) {
+	for i, line := range lines {
+		sep := byte('-')
+		if i == len(lines)-1 {
+			sep = ' '
+		}
+		fmt.Fprintf(sess.w, "%d%c%s\r\n", code, sep, line)
+	}
+}
+
+// dispatch handles one command line, reporting whether the session is
+// over (QUIT, or a fatal protocol error).
+func (sess *session) dispatch(line string) (done bool, err error) {
+	verb, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], line[i+1:]
+	}
+	switch strings.ToUpper(verb) {
+	case "EHLO":
+		sess.helo = arg
+		lines := []string{sess.hostname() + " greets " + arg, "PIPELINING", "8BITMIME"}
+		if sess.MaxSize > 0 {
+			lines = append(lines, fmt.Sprintf("SIZE %d", sess.MaxSize))
+		}
+		if sess.TLSConfig != nil && sess.conn != nil {
+			if _, ok := sess.conn.(*tls.Conn); !ok {
+				lines = append(lines, "STARTTLS")
+			}
+		}
+		if sess.Auth != nil && sess.tlsActive() {
+			lines = append(lines, "AUTH PLAIN LOGIN")
+		}
+		sess.replyLines(250, lines...)
+	case "HELO":
+		sess.helo = arg
+		sess.reply(250, "%s greets %s", sess.hostname(), arg)
+	case "STARTTLS":
+		sess.doStartTLS()
+	case "AUTH":
+		sess.doAuth(arg)
+	case "MAIL":
+		sess.doMail(arg)
+	case "RCPT":
+		sess.doRcpt(arg)
+	case "DATA":
+		sess.doData()
+	case "RSET":
+		sess.from, sess.to = nil, nil
+		sess.reply(250, "OK")
+	case "NOOP":
+		sess.reply(250, "OK")
+	case "QUIT":
+		sess.reply(221, "%s closing connection", sess.hostname())
+		return true, nil
+	default:
+		sess.reply(500, "unrecognized command")
+	}
+	return false, nil
+}
+
+func (sess *session) doStartTLS() {
+	if sess.TLSConfig == nil || sess.conn == nil {
+		sess.reply(502, "STARTTLS not supported")
+		return
+	}
+	if _, ok := sess.conn.(*tls.Conn); ok {
+		sess.reply(503, "already using TLS")
+		return
+	}
+	sess.reply(220, "ready to start TLS")
+	tconn := tls.Server(sess.conn, sess.TLSConfig)
+	sess.conn = tconn
+	sess.r = bufio.NewReader(tconn)
+	sess.w = tconn
+	// RFC 3207 requires discarding all state from before the TLS
+	// handshake, not just HELO/AUTH: otherwise a plaintext on-path
+	// attacker can inject MAIL/RCPT before the handshake and have them
+	// ride along into the encrypted session.
+	sess.helo, sess.authorized = "", false
+	sess.from, sess.to, sess.eightBitMIME = nil, nil, false
+}
+
+// tlsActive reports whether the connection has completed STARTTLS, or
+// TLS was never required in the first place.
+func (sess *session) tlsActive() bool {
+	if sess.TLSConfig == nil {
+		return true
+	}
+	_, ok := sess.conn.(*tls.Conn)
+	return ok
+}
+
+func (sess *session) doAuth(arg string) {
+	if sess.Auth == nil {
+		sess.reply(503, "AUTH not supported")
+		return
+	}
+	if !sess.tlsActive() {
+		sess.reply(538, "encryption required for requested authentication mechanism")
+		return
+	}
+	mech, rest, _ := strings.Cut(arg, " ")
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		if rest == "" {
+			sess.reply(334, "")
+			line, err := readLine(sess.r)
+			if err != nil {
+				return
+			}
+			rest = line
+		}
+		data, err := base64.StdEncoding.DecodeString(rest)
+		if err != nil {
+			sess.reply(501, "malformed AUTH PLAIN response")
+			return
+		}
+		parts := strings.SplitN(string(data), "\x00", 3)
+		if len(parts) != 3 {
+			sess.reply(501, "malformed AUTH PLAIN response")
+			return
+		}
+		sess.finishAuth("PLAIN", parts[1], parts[2])
+	case "LOGIN":
+		sess.reply(334, base64.StdEncoding.EncodeToString([]byte("Username:")))
+		userLine, err := readLine(sess.r)
+		if err != nil {
+			return
+		}
+		sess.reply(334, base64.StdEncoding.EncodeToString([]byte("Password:")))
+		passLine, err := readLine(sess.r)
+		if err != nil {
+			return
+		}
+		user, err1 := base64.StdEncoding.DecodeString(userLine)
+		pass, err2 := base64.StdEncoding.DecodeString(passLine)
+		if err1 != nil || err2 != nil {
+			sess.reply(501, "malformed AUTH LOGIN response")
+			return
+		}
+		sess.finishAuth("LOGIN", string(user), string(pass))
+	default:
+		sess.reply(504, "unsupported AUTH mechanism")
+	}
+}
+
+func (sess *session) finishAuth(mech, user, pass string) {
+	if sess.Auth(mech, user, pass) {
+		sess.authorized = true
+		sess.reply(235, "authentication successful")
+	} else {
+		sess.reply(535, "authentication failed")
+	}
+}
+
+func (sess *session) doMail(arg string) {
+	if sess.Auth != nil && !sess.authorized {
+		sess.reply(530, "authentication required")
+		return
+	}
+	addr, params, ok := parseMailRcptArg("FROM:", arg)
+	if !ok {
+		sess.reply(501, "malformed MAIL FROM")
+		return
+	}
+	sess.eightBitMIME = strings.Contains(strings.ToUpper(params), "BODY=8BITMIME")
+	sess.from = addr
+	sess.to = nil
+	sess.reply(250, "OK")
+}
+
+func (sess *session) doRcpt(arg string) {
+	if sess.from == nil {
+		sess.reply(503, "need MAIL before RCPT")
+		return
+	}
+	addr, _, ok := parseMailRcptArg("TO:", arg)
+	if !ok {
+		sess.reply(501, "malformed RCPT TO")
+		return
+	}
+	sess.to = append(sess.to, addr)
+	sess.reply(250, "OK")
+}
+
+// parseMailRcptArg parses the "FROM:<addr> PARAM=VALUE ..." or
+// "TO:<addr> PARAM=VALUE ..." argument of a MAIL or RCPT command.
+func parseMailRcptArg(prefix, arg string) (addr *mail.Address, params string, ok bool) {
+	if !strings.HasPrefix(strings.ToUpper(arg), prefix) {
+		return nil, "", false
+	}
+	rest := arg[len(prefix):]
+	end := strings.IndexByte(rest, '>')
+	if !strings.HasPrefix(rest, "<") || end < 0 {
+		return nil, "", false
+	}
+	path, params := rest[1:end], strings.TrimSpace(rest[end+1:])
+	if path == "" {
+		// The null reverse path, "MAIL FROM:<>", used for bounces.
+		return &mail.Address{}, params, true
+	}
+	a, err := mail.ParseAddress(path)
+	if err != nil {
+		return nil, "", false
+	}
+	return a, params, true
+}
+
+func (sess *session) doData() {
+	if sess.from == nil || len(sess.to) == 0 {
+		sess.reply(503, "need MAIL and RCPT before DATA")
+		return
+	}
+	sess.reply(354, "go ahead")
+	r := unstuffDots(NewDotStopReader(sess.r))
+	data, err := readLimited(r, sess.MaxSize)
+	if err != nil {
+		if err == errMessageTooLarge {
+			// Drain the rest of the transmission so the connection
+			// stays in sync with the client before replying; we just
+			// don't keep more than MaxSize bytes of it in memory.
+			io.Copy(io.Discard, r)
+			sess.reply(552, "message exceeds maximum size of %d bytes", sess.MaxSize)
+			return
+		}
+		sess.reply(451, "error reading message: %v", err)
+		return
+	}
+
+	data, bcc := stripBcc(data)
+	archive := ArchiveOptions{Bcc: bcc}
+	archive.ImapURL, _ = ConfigValue("imap")
+
+	if err := sess.submit(data, archive); err != nil {
+		var terr TransientError
+		code := 550
+		if errors.As(err, &terr) {
+			code = 451
+		}
+		sess.reply(code, "error submitting message: %v", err)
+		return
+	}
+	sess.reply(250, "OK: message accepted")
+	sess.from, sess.to = nil, nil
+}
+
+// errMessageTooLarge is returned by readLimited when r has more than
+// maxSize bytes remaining.
+var errMessageTooLarge = errors.New("message too large")
+
+// readLimited reads all of r, or reports errMessageTooLarge without
+// buffering more than maxSize+1 bytes if r has more than maxSize bytes
+// to give. maxSize <= 0 means unlimited.
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return io.ReadAll(r)
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, maxSize+1)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n > maxSize {
+		return nil, errMessageTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// submit runs the shared Prepare policy/DKIM pipeline and spools the
+// result to the on-disk queue, the same path mailgun-sendmail's
+// enqueueOrSend uses, so a connection never blocks on (or is killed by)
+// a synchronous call to Mailgun. It falls back to SendMIME, which
+// reports failure instead of exiting the process, only if the queue
+// can't be opened.
+func (sess *session) submit(data []byte, archive ArchiveOptions) error {
+	q, err := OpenQueue("")
+	if err == nil {
+		_, err := Submit(q, sess.from, sess.to, data, archive)
+		return err
+	}
+	Logf("smtpd: queue unavailable, sending synchronously: %v", err)
+	to, mime, perr := Prepare(sess.from, sess.to, data)
+	if perr != nil {
+		if errors.Is(perr, ErrAllRecipientsDropped) {
+			Logf("policy: dropped message from %s: no recipients remain", sess.from.Address)
+			return nil
+		}
+		return perr
+	}
+	if serr := SendMIME(sess.from, to, bytes.NewReader(mime)); serr != nil {
+		return serr
+	}
+	Archive(mime, archive)
+	return nil
+}
+
+// stripBcc removes any Bcc header from data before it is sent to Mailgun,
+// returning the edited message and the removed addresses so they can be
+// restored into an archived copy. If data isn't parsable as an RFC 822
+// message, it is returned unchanged.
+func stripBcc(data []byte) ([]byte, []string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return data, nil
+	}
+	bcc := msg.Header["Bcc"]
+	if len(bcc) == 0 {
+		return data, nil
+	}
+	delete(msg.Header, "Bcc")
+	out, err := reserializeMessage(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		return data, nil
+	}
+	return out, bcc
+}
+
+// unstuffDots removes the leading "." that SMTP transparency (RFC 5321
+// 4.5.2) adds to any message line that originally began with one.
+func unstuffDots(r io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		br := bufio.NewReader(r)
+		for {
+			line, err := br.ReadString('\n')
+			if len(line) > 0 {
+				if strings.HasPrefix(line, "..") {
+					line = line[1:]
+				}
+				if _, werr := io.WriteString(pw, line); werr != nil {
+					pw.CloseWithError(werr)
+					return
+				}
+			}
+			if err != nil {
+				if err == io.EOF {
+					pw.Close()
+				} else {
+					pw.CloseWithError(err)
+				}
+				return
+			}
+		}
+	}()
+	return pr
+}
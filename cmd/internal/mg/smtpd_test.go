@@ -0,0 +1,105 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mg
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// stuff applies RFC 5321 dot-stuffing to msg (doubling any line that
+// begins with a ".") and appends the end-of-data terminator, the way an
+// SMTP client transmits a DATA payload on the wire.
+func stuff(msg string) string {
+	lines := strings.SplitAfter(msg, "\r\n")
+	var out strings.Builder
+	for _, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			out.WriteByte('.')
+		}
+		out.WriteString(line)
+	}
+	out.WriteString(".\r\n")
+	return out.String()
+}
+
+func TestDotStopReaderRoundTrip(t *testing.T) {
+	cases := []string{
+		"Subject: hello.\r\n\r\nBody\r\n",
+		"Subject: test\r\n\r\n.leading dot line\r\nmore body.\r\n",
+		"\r\n",
+		"one line, no trailing blank\r\n",
+	}
+	for _, msg := range cases {
+		wire := stuff(msg)
+		r := unstuffDots(NewDotStopReader(strings.NewReader(wire)))
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Errorf("stuff(%q): ReadAll: %v", msg, err)
+			continue
+		}
+		if string(got) != msg {
+			t.Errorf("stuff(%q) round-tripped to %q", msg, got)
+		}
+	}
+}
+
+func TestDotStopReaderStopsAtTerminator(t *testing.T) {
+	wire := stuff("Body\r\n") + "garbage that belongs to the next command\r\n"
+	r := NewDotStopReader(strings.NewReader(wire))
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if bytes.Contains(got, []byte("garbage")) {
+		t.Errorf("DotStopReader read past the terminator: %q", got)
+	}
+}
+
+func TestReadLimited(t *testing.T) {
+	if _, err := readLimited(strings.NewReader("0123456789"), 0); err != nil {
+		t.Errorf("readLimited with maxSize 0 (unlimited): %v", err)
+	}
+
+	got, err := readLimited(strings.NewReader("0123456789"), 10)
+	if err != nil {
+		t.Fatalf("readLimited at the limit: %v", err)
+	}
+	if string(got) != "0123456789" {
+		t.Errorf("readLimited at the limit = %q, want %q", got, "0123456789")
+	}
+
+	if _, err := readLimited(strings.NewReader("0123456789"), 9); err != errMessageTooLarge {
+		t.Errorf("readLimited one byte over the limit: err = %v, want errMessageTooLarge", err)
+	}
+}
+
+func TestParseMailRcptArg(t *testing.T) {
+	tests := []struct {
+		prefix  string
+		arg     string
+		wantOK  bool
+		wantAdr string
+	}{
+		{"FROM:", "FROM:<a@example.com>", true, "a@example.com"},
+		{"FROM:", "FROM:<a@example.com> BODY=8BITMIME", true, "a@example.com"},
+		{"FROM:", "FROM:<>", true, ""},
+		{"TO:", "TO:<b@example.com>", true, "b@example.com"},
+		{"TO:", "garbage", false, ""},
+		{"TO:", "TO:noangle@example.com", false, ""},
+	}
+	for _, tt := range tests {
+		addr, _, ok := parseMailRcptArg(tt.prefix, tt.arg)
+		if ok != tt.wantOK {
+			t.Errorf("parseMailRcptArg(%q, %q) ok = %v, want %v", tt.prefix, tt.arg, ok, tt.wantOK)
+			continue
+		}
+		if ok && addr.Address != tt.wantAdr {
+			t.Errorf("parseMailRcptArg(%q, %q) addr = %q, want %q", tt.prefix, tt.arg, addr.Address, tt.wantAdr)
+		}
+	}
+}
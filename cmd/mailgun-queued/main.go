@@ -0,0 +1,56 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Mailgun-queued is the background worker for the mailgun-sendmail
+// spool: it periodically retries delivery of every queued message,
+// honoring each message's backoff schedule, and bounces messages that
+// have been undeliverable for longer than mg.MaxAge.
+//
+// Usage:
+//
+//	mailgun-queued [-v] [-dir path] [-q time]
+//
+// The options are:
+//
+//	-dir path
+//	    spool directory to drain (default /var/spool/mailgun)
+//	-q time
+//	    how often to sweep the queue (default 30m)
+//	-v
+//	    verbose mode
+//
+// Configuration is as described in mailgun-sendmail.
+package main
+
+import (
+	"flag"
+	"time"
+
+	"rsc.io/mailgun/cmd/internal/mg"
+)
+
+var (
+	dirFlag = flag.String("dir", "", "spool `directory` to drain (default "+mg.DefaultQueueDir+")")
+	qFlag   = flag.Duration("q", 30*time.Minute, "how often to sweep the queue")
+	vFlag   = flag.Bool("v", false, "verbose mode")
+)
+
+func main() {
+	mg.Init()
+	flag.Parse()
+	mg.Verbose = *vFlag
+
+	q, err := mg.OpenQueue(*dirFlag)
+	if err != nil {
+		mg.Die(err)
+	}
+
+	mg.Logf("mailgun-queued draining %s every %s", q.Dir, *qFlag)
+	for {
+		if err := q.Run(); err != nil {
+			mg.Logf("queue run: %v", err)
+		}
+		time.Sleep(*qFlag)
+	}
+}
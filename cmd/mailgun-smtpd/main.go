@@ -0,0 +1,91 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Mailgun-smtpd is an SMTP submission server that relays accepted mail
+// through Mailgun, for use by MUAs, MTAs, and tools such as msmtp and
+// git send-email that speak SMTP but not the sendmail command-line
+// convention.
+//
+// Usage:
+//
+//	mailgun-smtpd [-v] [-addr host:port] [-hostname name] [-auth] [-cert file -key file] [-maxsize bytes]
+//
+// The options are:
+//
+//	-addr host:port
+//	    address to listen on (default ":587")
+//	-hostname name
+//	    hostname to advertise in the greeting and EHLO response
+//	    (default: the system hostname)
+//	-auth
+//	    require AUTH PLAIN or AUTH LOGIN before accepting mail, checked
+//	    against the credential in $MAILGUNKEY/.mailgun.key
+//	-cert file, -key file
+//	    certificate and private key to offer STARTTLS; both are required
+//	    to enable it
+//	-maxsize bytes
+//	    reject DATA larger than bytes, advertised to clients via the
+//	    SIZE extension (default: unlimited)
+//	-v
+//	    verbose mode
+//
+// Configuration is as described in mailgun-sendmail.
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+
+	"rsc.io/mailgun/cmd/internal/mg"
+)
+
+var (
+	addrFlag     = flag.String("addr", ":587", "address to listen on")
+	hostnameFlag = flag.String("hostname", "", "hostname to advertise (default: system hostname)")
+	authFlag     = flag.Bool("auth", false, "require AUTH before accepting mail")
+	certFlag     = flag.String("cert", "", "certificate `file` for STARTTLS")
+	keyFlag      = flag.String("key", "", "private key `file` for STARTTLS")
+	maxSizeFlag  = flag.Int64("maxsize", 0, "reject DATA larger than `bytes` (default: unlimited)")
+	vFlag        = flag.Bool("v", false, "verbose mode")
+)
+
+func main() {
+	mg.Init()
+	flag.Parse()
+	mg.Verbose = *vFlag
+
+	hostname := *hostnameFlag
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+
+	cfg := mg.Config{Hostname: hostname, MaxSize: *maxSizeFlag}
+	if *authFlag {
+		cfg.Auth = checkAuth
+	}
+	if *certFlag != "" || *keyFlag != "" {
+		cert, err := tls.LoadX509KeyPair(*certFlag, *keyFlag)
+		if err != nil {
+			mg.Die(fmt.Errorf("loading TLS certificate: %v", err))
+		}
+		cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	l, err := net.Listen("tcp", *addrFlag)
+	if err != nil {
+		mg.Die(fmt.Errorf("listen: %v", err))
+	}
+	mg.Logf("mailgun-smtpd listening on %s", *addrFlag)
+	mg.Die(mg.NewServer(cfg).Serve(l))
+}
+
+// checkAuth validates AUTH credentials against the same key configured
+// for mailgun-sendmail: the Mailgun API domain acts as the username and
+// the API key as the password.
+func checkAuth(mechanism, user, pass string) bool {
+	return mg.CheckAuth(user, pass)
+}